@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+// EC2Instance captures the subset of an EC2 instance's metadata rbIAM needs
+// to resolve the IAM role a pod inherits when it isn't using IRSA: the
+// addresses a pod's Status.HostIP can be matched against, and the instance
+// profile attached to the node, which is resolved to an underlying role ARN
+// by resolveInstanceProfileRoles.
+type EC2Instance struct {
+	PrivateIpAddress   string
+	PublicIpAddress    string
+	IamInstanceProfile string // ARN, as returned by ec2.DescribeInstances
+	NodeInstanceRole   string // role ARN backing IamInstanceProfile, filled in by resolveInstanceProfileRoles
+}
+
+// scrapeEC2Instances calls ec2.DescribeInstances and records every
+// instance's addresses and instance profile on ag.EC2Instances, keyed by
+// instance ID, so resolveInstanceProfileRoles has profiles to resolve and
+// resolveNodeRole has addresses to match a pod's Status.HostIP against.
+func scrapeEC2Instances(ec2Client ec2iface.EC2API, ag *AccessGraph) error {
+	if ag.EC2Instances == nil {
+		ag.EC2Instances = make(map[string]EC2Instance)
+	}
+	return ec2Client.DescribeInstancesPages(&ec2.DescribeInstancesInput{}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				inst := EC2Instance{
+					PrivateIpAddress: aws.StringValue(instance.PrivateIpAddress),
+					PublicIpAddress:  aws.StringValue(instance.PublicIpAddress),
+				}
+				if instance.IamInstanceProfile != nil {
+					inst.IamInstanceProfile = aws.StringValue(instance.IamInstanceProfile.Arn)
+				}
+				ag.EC2Instances[aws.StringValue(instance.InstanceId)] = inst
+			}
+		}
+		return true
+	})
+}
+
+// resolveInstanceProfileRoles calls iam.GetInstanceProfile for every unique
+// instance profile attached to the scraped EC2 instances and records the
+// underlying role ARN on each EC2Instance as NodeInstanceRole, so exportGraph
+// can draw pod -> role edges for nodes that don't use IRSA.
+func resolveInstanceProfileRoles(iamClient iamiface.IAMAPI, ag *AccessGraph) error {
+	resolved := map[string]string{}
+	for id, inst := range ag.EC2Instances {
+		if inst.IamInstanceProfile == "" {
+			continue
+		}
+		roleARN, ok := resolved[inst.IamInstanceProfile]
+		if !ok {
+			out, err := iamClient.GetInstanceProfile(&iam.GetInstanceProfileInput{
+				InstanceProfileName: aws.String(instanceProfileNameFromARN(inst.IamInstanceProfile)),
+			})
+			if err != nil {
+				return err
+			}
+			if len(out.InstanceProfile.Roles) == 0 {
+				continue
+			}
+			roleARN = aws.StringValue(out.InstanceProfile.Roles[0].Arn)
+			resolved[inst.IamInstanceProfile] = roleARN
+		}
+		inst.NodeInstanceRole = roleARN
+		ag.EC2Instances[id] = inst
+	}
+	return nil
+}
+
+// instanceProfileNameFromARN extracts the instance profile name from an ARN
+// of the form arn:aws:iam::123456789012:instance-profile/name, or, when the
+// profile has a non-default IAM path (common in orgs that scope permission
+// boundaries or SCPs by path), arn:aws:iam::123456789012:instance-profile/some/path/name.
+// iam.GetInstanceProfileInput takes a bare name with no '/', so we need the
+// final path segment, not everything after the first slash.
+func instanceProfileNameFromARN(arn string) string {
+	i := len(arn) - 1
+	for i >= 0 && arn[i] != '/' {
+		i--
+	}
+	return arn[i+1:]
+}
+
+// resolveNodeRole looks up the EC2 instance whose private or public IP
+// matches hostIP and returns the ARN of the IAM role backing its instance
+// profile. This is how a pod that doesn't set AWS_ROLE_ARN (i.e. isn't using
+// IRSA) ends up with AWS credentials: it inherits whatever role is attached
+// to the node it's scheduled on.
+func resolveNodeRole(ag *AccessGraph, hostIP string) (string, bool) {
+	if hostIP == "" {
+		return "", false
+	}
+	for _, inst := range ag.EC2Instances {
+		if inst.PrivateIpAddress == hostIP || inst.PublicIpAddress == hostIP {
+			if inst.NodeInstanceRole == "" {
+				return "", false
+			}
+			return inst.NodeInstanceRole, true
+		}
+	}
+	return "", false
+}
@@ -4,10 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/emicklei/dot"
+	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
 )
 
 // dump exports the entire access graph.
@@ -74,6 +80,15 @@ func exportRaw(trace []string, ag *AccessGraph) (string, error) {
 		}
 	}
 
+	// the findings section follows the JSON objects as plain text, one line
+	// per finding, and lists every finding in ag, not only the traced ones:
+	if len(ag.Findings) > 0 {
+		dump = fmt.Sprintf("%v\n\nFindings:", dump)
+		for _, f := range ag.Findings {
+			dump = fmt.Sprintf("%v\n%v -> %v: %v", dump, f.From, f.To, f.Reason)
+		}
+	}
+
 	filename := fmt.Sprintf("rbiam-trace-%v.json", time.Now().Unix())
 	err := ioutil.WriteFile(filename, []byte(dump), 0644)
 	if err != nil {
@@ -97,9 +112,11 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 	lpod := formatAsPod(legend.Node("Kubernetes pod"))
 	lrole := formatAsRole(legend.Node("IAM role"))
 	lpolicy := formatAsPolicy(legend.Node("IAM policy"))
+	linline := formatAsInlinePolicy(legend.Node("IAM inline policy"))
 	legend.Edge(lpod, lsa, "uses").Attr("fontname", "Helvetica")
 	legend.Edge(lsa, lsecret, "has").Attr("fontname", "Helvetica")
 	legend.Edge(lrole, lpolicy, "has").Attr("fontname", "Helvetica")
+	legend.Edge(lrole, linline, "has").Attr("fontname", "Helvetica")
 	legend.Edge(lpod, lrole, "assumes").Attr("fontname", "Helvetica")
 
 	// first let's draw the nodes and remember the
@@ -154,6 +171,7 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 	}
 	// pods -> IAM roles
 	for podname, node := range pods {
+		irsa := false
 		for _, item := range trace {
 			itype, ikey := extractTK(item)
 			if itype == "IAM role" {
@@ -162,18 +180,86 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 					for _, envar := range container.Env {
 						if envar.Name == "AWS_ROLE_ARN" && envar.Value == ikey {
 							g.Edge(node, roles[ikey])
+							irsa = true
 						}
 					}
 				}
-				// for traditional, node-level IAM role assignment:
-				// iterate over EC2 instances and select the ones where the
-				// pods' hostIP matches, then take the EC2 NodeInstanceRole
+			}
+		}
+		// for traditional, node-level IAM role assignment: resolve the EC2
+		// instance the pod is scheduled on via its hostIP, then draw an edge
+		// to the role backing that instance's profile.
+		if !irsa {
+			if roleARN, ok := resolveNodeRole(ag, ag.Pods[podname].Status.HostIP); ok {
+				if roleNode, ok := roles[roleARN]; ok {
+					g.Edge(node, roleNode)
+				}
 			}
 		}
 	}
 
 	// IAM roles -> IAM policies
-	// https://godoc.org/github.com/aws/aws-sdk-go-v2/service/iam#Client.ListAttachedRolePoliciesRequest
+	// attached policies have their own ARN and so appear in the policies map
+	// above; inline policies don't, so we create a distinguished node for
+	// each the first time we see it.
+	inlinePolicies := make(map[string]dot.Node)
+	for roleARN, roleNode := range roles {
+		role := ag.Roles[roleARN]
+		for _, policyARN := range role.AttachedPolicies {
+			if policyNode, ok := policies[policyARN]; ok {
+				g.Edge(roleNode, policyNode)
+			}
+		}
+		for _, policyName := range role.InlinePolicies {
+			key := roleARN + ":" + policyName
+			inlineNode, ok := inlinePolicies[key]
+			if !ok {
+				inlineNode = formatAsInlinePolicy(g.Node(key).Attr("label", policyName))
+				inlinePolicies[key] = inlineNode
+			}
+			g.Edge(roleNode, inlineNode)
+		}
+	}
+
+	// IRSA misconfigurations: drawn as red dashed edges labeled with the
+	// failure reason, so a bad wiring shows up right next to the edge it
+	// was supposed to produce.
+	nodesByItem := func(item string) (dot.Node, bool) {
+		itype, ikey := extractTK(item)
+		switch itype {
+		case "IAM role":
+			n, ok := roles[ikey]
+			return n, ok
+		case "IAM policy":
+			n, ok := policies[ikey]
+			return n, ok
+		case "Kubernetes service account":
+			n, ok := sas[ikey]
+			return n, ok
+		case "Kubernetes secret":
+			n, ok := secrets[ikey]
+			return n, ok
+		case "Kubernetes pod":
+			n, ok := pods[ikey]
+			return n, ok
+		}
+		return dot.Node{}, false
+	}
+	for _, finding := range ag.Findings {
+		from, ok := nodesByItem(finding.From)
+		if !ok {
+			continue
+		}
+		to, ok := nodesByItem(finding.To)
+		if !ok {
+			continue
+		}
+		g.Edge(from, to, finding.Reason).
+			Attr("color", "#FF0000").
+			Attr("style", "dashed").
+			Attr("fontcolor", "#FF0000").
+			Attr("fontname", "Helvetica")
+	}
 
 	// now we can write out the graph into a file in DOT format:
 	filename := fmt.Sprintf("rbiam-trace-%v.dot", time.Now().Unix())
@@ -184,6 +270,262 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 	return filename, nil
 }
 
+// exportCypher exports the trace as a set of idempotent Cypher MERGE
+// statements into a file in the current working directory with a name of
+// 'rbiam-trace-NNNNNNNNNN.cypher' with the NNNNNNNNNN being the Unix
+// timestamp of the creation time, for example:
+// rbiam-trace-1564315687.cypher
+//
+// Every node and relationship is MERGEd on a stable key rather than CREATEd,
+// so replaying the same dump (or an overlapping one) through this file, or
+// through ingestBolt, never produces duplicates.
+func exportCypher(trace []string, ag *AccessGraph) (string, error) {
+	stmts := cypherStatements(trace, ag)
+	filename := fmt.Sprintf("rbiam-trace-%v.cypher", time.Now().Unix())
+	err := ioutil.WriteFile(filename, []byte(strings.Join(stmts, "\n")), 0644)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// ingestBolt batch-executes the same kind of MERGE statements exportCypher
+// writes to disk directly against a live Neo4j instance over Bolt, so an
+// accumulated history of dumps can be queried (e.g. "which pods can reach
+// S3?") without a manual cypher-shell import step. Unlike exportCypher it
+// takes no trace: it ingests every entry of ag.
+func ingestBolt(uri, user, pass string, ag *AccessGraph) error {
+	driver, err := neo4j.NewDriver(uri, neo4j.BasicAuth(user, pass, ""))
+	if err != nil {
+		return err
+	}
+	defer driver.Close()
+
+	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer session.Close()
+
+	stmts := cypherStatements(allTraceItems(ag), ag)
+	_, err = session.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		for _, stmt := range stmts {
+			if _, err := tx.Run(stmt, nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// cypherStatements renders the nodes and relationships of a trace as
+// idempotent MERGE statements, mirroring the node/edge types exportGraph
+// already draws in DOT form.
+func cypherStatements(trace []string, ag *AccessGraph) []string {
+	var stmts []string
+	for _, item := range trace {
+		itype, ikey := extractTK(item)
+		switch itype {
+		case "IAM role":
+			stmts = append(stmts, mergeNode("Role", "arn", ikey))
+		case "IAM policy":
+			stmts = append(stmts, mergeNode("Policy", "arn", ikey))
+		case "Kubernetes service account":
+			stmts = append(stmts, mergeNode("ServiceAccount", "key", ikey))
+		case "Kubernetes secret":
+			stmts = append(stmts, mergeNode("Secret", "key", ikey))
+		case "Kubernetes pod":
+			stmts = append(stmts, mergeNode("Pod", "key", ikey))
+		}
+	}
+	stmts = append(stmts, cypherRelationships(trace, ag)...)
+	return stmts
+}
+
+// mergeNode renders an idempotent MERGE statement for a single typed node,
+// keyed on the given unique property (ARN for IAM roles/policies, namespaced
+// name for everything else) so repeat ingestion never duplicates it.
+func mergeNode(label, key, value string) string {
+	return fmt.Sprintf("MERGE (n:%v {%v: %q});", label, key, value)
+}
+
+// cypherRelationships mirrors the pod->serviceaccount, serviceaccount->secret,
+// pod->role and role->policy (attached and inline) edges exportGraph draws,
+// emitting one idempotent MERGE per edge.
+func cypherRelationships(trace []string, ag *AccessGraph) []string {
+	var stmts []string
+	for _, item := range trace {
+		itype, ikey := extractTK(item)
+		switch itype {
+		case "Kubernetes pod":
+			podsa := namespaceit(ag.Pods[ikey].Namespace, ag.Pods[ikey].Spec.ServiceAccountName)
+			stmts = append(stmts, fmt.Sprintf(
+				"MATCH (p:Pod {key: %q}), (sa:ServiceAccount {key: %q}) MERGE (p)-[:USES]->(sa);",
+				ikey, podsa))
+			irsa := false
+			for _, container := range ag.Pods[ikey].Spec.Containers {
+				for _, envar := range container.Env {
+					if envar.Name == "AWS_ROLE_ARN" {
+						stmts = append(stmts, fmt.Sprintf(
+							"MATCH (p:Pod {key: %q}), (r:Role {arn: %q}) MERGE (p)-[:ASSUMES]->(r);",
+							ikey, envar.Value))
+						irsa = true
+					}
+				}
+			}
+			// traditional, node-level IAM role assignment for pods not
+			// carrying AWS_ROLE_ARN (i.e. not using IRSA):
+			if !irsa {
+				if roleARN, ok := resolveNodeRole(ag, ag.Pods[ikey].Status.HostIP); ok {
+					stmts = append(stmts, fmt.Sprintf(
+						"MATCH (p:Pod {key: %q}), (r:Role {arn: %q}) MERGE (p)-[:ASSUMES]->(r);",
+						ikey, roleARN))
+				}
+			}
+		case "Kubernetes service account":
+			if len(ag.ServiceAccounts[ikey].Secrets) > 0 {
+				sasecret := namespaceit(ag.ServiceAccounts[ikey].Namespace, ag.ServiceAccounts[ikey].Secrets[0].Name)
+				stmts = append(stmts, fmt.Sprintf(
+					"MATCH (sa:ServiceAccount {key: %q}), (s:Secret {key: %q}) MERGE (sa)-[:HAS]->(s);",
+					ikey, sasecret))
+			}
+		case "IAM role":
+			for _, policyARN := range ag.Roles[ikey].AttachedPolicies {
+				stmts = append(stmts, fmt.Sprintf(
+					"MATCH (r:Role {arn: %q}), (p:Policy {arn: %q}) MERGE (r)-[:HAS]->(p);",
+					ikey, policyARN))
+			}
+			for _, policyName := range ag.Roles[ikey].InlinePolicies {
+				stmts = append(stmts, fmt.Sprintf(
+					"MERGE (p:InlinePolicy {key: %q});", ikey+":"+policyName))
+				stmts = append(stmts, fmt.Sprintf(
+					"MATCH (r:Role {arn: %q}), (p:InlinePolicy {key: %q}) MERGE (r)-[:HAS]->(p);",
+					ikey, ikey+":"+policyName))
+			}
+		}
+	}
+	return stmts
+}
+
+// allTraceItems flattens every entry of the access graph into the same
+// "[TYPE] KEY" form the live trace walker produces, so ingestBolt can push a
+// whole graph through cypherStatements without a trace having been recorded.
+func allTraceItems(ag *AccessGraph) []string {
+	var items []string
+	for k := range ag.Pods {
+		items = append(items, fmt.Sprintf("[Kubernetes pod] %v", k))
+	}
+	for k := range ag.ServiceAccounts {
+		items = append(items, fmt.Sprintf("[Kubernetes service account] %v", k))
+	}
+	for k := range ag.Secrets {
+		items = append(items, fmt.Sprintf("[Kubernetes secret] %v", k))
+	}
+	for k := range ag.Roles {
+		items = append(items, fmt.Sprintf("[IAM role] %v", k))
+	}
+	for k := range ag.Policies {
+		items = append(items, fmt.Sprintf("[IAM policy] %v", k))
+	}
+	return items
+}
+
+// exportManifests reconstructs the minimal set of objects needed to recreate
+// an access path from a trace, and writes them as YAML/JSON into a directory
+// in the current working directory named 'rbiam-manifests-NNNNNNNNNN' with
+// the NNNNNNNNNN being the Unix timestamp of the creation time, for example:
+// rbiam-manifests-1564315687. Each object is serialized to its canonical
+// schema rather than raw JSON, so the output can be handed to GitOps tooling
+// or diffed against a source of truth without hand-transcribing from the DOT
+// graph.
+func exportManifests(trace []string, ag *AccessGraph) (string, error) {
+	dirname := fmt.Sprintf("rbiam-manifests-%v", time.Now().Unix())
+	if err := os.MkdirAll(dirname, 0755); err != nil {
+		return "", err
+	}
+
+	for _, item := range trace {
+		itype, ikey := extractTK(item)
+		switch itype {
+		case "Kubernetes service account":
+			sa := serviceAccountManifest(ag.ServiceAccounts[ikey])
+			if err := writeManifest(dirname, "serviceaccount-"+sanitizeFilename(ikey)+".yaml", sa); err != nil {
+				return "", err
+			}
+		case "Kubernetes pod":
+			pod := podManifest(ag.Pods[ikey])
+			if err := writeManifest(dirname, "pod-"+sanitizeFilename(ikey)+".yaml", pod); err != nil {
+				return "", err
+			}
+		case "IAM role":
+			role := ag.Roles[ikey]
+			if err := writeManifest(dirname, "role-"+sanitizeFilename(ikey)+"-trust-policy.json", role.TrustPolicy); err != nil {
+				return "", err
+			}
+		case "IAM policy":
+			policy := ag.Policies[ikey]
+			if err := writeManifest(dirname, "policy-"+sanitizeFilename(ikey)+".json", policy.Document); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return dirname, nil
+}
+
+// serviceAccountManifest strips a scraped ServiceAccount down to the fields
+// needed to recreate it (name, namespace, its annotations, the IRSA one
+// included, and the secrets it references) and sets TypeMeta, which client-go's typed clients
+// leave blank, so the YAML is `kubectl apply`-able on its own.
+func serviceAccountManifest(sa corev1.ServiceAccount) corev1.ServiceAccount {
+	return corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        sa.Name,
+			Namespace:   sa.Namespace,
+			Annotations: sa.Annotations,
+		},
+		Secrets: sa.Secrets,
+	}
+}
+
+// podManifest strips a scraped Pod down to the fields needed to recreate the
+// access path (name, namespace, and the spec carrying the env and projected
+// token volume) and sets TypeMeta, dropping Status/ResourceVersion/UID/etc.
+// that only make sense for a live, already-running object.
+func podManifest(pod corev1.Pod) corev1.Pod {
+	return corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		Spec: pod.Spec,
+	}
+}
+
+// writeManifest serializes obj to its canonical schema (YAML for anything
+// that isn't already a JSON-encoded string, such as a trust policy document)
+// and writes it under dirname/name.
+func writeManifest(dirname, name string, obj interface{}) error {
+	var b []byte
+	var err error
+	if s, ok := obj.(string); ok {
+		b = []byte(s)
+	} else {
+		b, err = yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dirname, name), b, 0644)
+}
+
+// sanitizeFilename replaces characters that don't belong in a filename (':'
+// in namespace:name keys, '/' in ARNs) with '_'.
+func sanitizeFilename(key string) string {
+	replacer := strings.NewReplacer(":", "_", "/", "_")
+	return replacer.Replace(key)
+}
+
 // extractTK takes a history item in the form [TYPE] KEY
 // and return t as the TYPE and k as the KEY, for example:
 // [Kubernetes service account] default:s3-echoer ->
@@ -203,6 +545,13 @@ func formatAsPolicy(n dot.Node) dot.Node {
 	return n.Attr("style", "filled").Attr("fillcolor", "#D9A7F1").Attr("fontcolor", "#000000").Attr("fontname", "Helvetica")
 }
 
+// formatAsInlinePolicy styles an inline policy, i.e. one with no ARN of its
+// own because it lives embedded in its role, with a dashed border so it
+// reads as distinct from an attached (managed) policy.
+func formatAsInlinePolicy(n dot.Node) dot.Node {
+	return n.Attr("style", "filled,dashed").Attr("fillcolor", "#D9A7F1").Attr("fontcolor", "#000000").Attr("fontname", "Helvetica")
+}
+
 func formatAsServiceAccount(n dot.Node) dot.Node {
 	return n.Attr("style", "filled").Attr("fillcolor", "#1BFF9F").Attr("fontcolor", "#000000").Attr("fontname", "Helvetica")
 }
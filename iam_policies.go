@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+// scrapeRolePolicies populates AttachedPolicies and InlinePolicies on every
+// role already present in ag by calling iam.ListAttachedRolePolicies and
+// iam.ListRolePolicies, so exportGraph has something to draw the
+// "IAM roles -> IAM policies" edge from. It runs as part of the scrape
+// itself (every role is known by then), rather than against a trace, which
+// is only ever a user-selected subset of the graph.
+func scrapeRolePolicies(iamClient iamiface.IAMAPI, ag *AccessGraph) error {
+	for roleARN, role := range ag.Roles {
+		roleName := roleNameFromARN(roleARN)
+
+		attached, err := iamClient.ListAttachedRolePolicies(&iam.ListAttachedRolePoliciesInput{
+			RoleName: aws.String(roleName),
+		})
+		if err != nil {
+			return err
+		}
+		role.AttachedPolicies = nil
+		for _, p := range attached.AttachedPolicies {
+			role.AttachedPolicies = append(role.AttachedPolicies, aws.StringValue(p.PolicyArn))
+		}
+
+		inline, err := iamClient.ListRolePolicies(&iam.ListRolePoliciesInput{
+			RoleName: aws.String(roleName),
+		})
+		if err != nil {
+			return err
+		}
+		role.InlinePolicies = nil
+		for _, name := range inline.PolicyNames {
+			role.InlinePolicies = append(role.InlinePolicies, aws.StringValue(name))
+		}
+
+		ag.Roles[roleARN] = role
+	}
+	return nil
+}
+
+// roleNameFromARN extracts the role name from an ARN of the form
+// arn:aws:iam::123456789012:role/name, since the ListAttachedRolePolicies and
+// ListRolePolicies APIs take a name rather than an ARN.
+func roleNameFromARN(arn string) string {
+	i := len(arn) - 1
+	for i >= 0 && arn[i] != '/' {
+		i--
+	}
+	return arn[i+1:]
+}
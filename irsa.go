@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Finding is a single IRSA wiring mistake detected by validateIRSA, anchored
+// to the two graph nodes it's between (From, To) so exportGraph can draw it
+// as an edge and exportRaw can list it as plain text.
+type Finding struct {
+	From   string // "[TYPE] KEY" of the node the problem originates from
+	To     string // "[TYPE] KEY" of the node the problem references, if any
+	Reason string
+}
+
+// validateIRSA cross-checks the access graph for common IRSA wiring mistakes
+// and returns them as Findings. It does not mutate ag; callers that want the
+// results attached to the graph should assign the return value to
+// ag.Findings themselves.
+func validateIRSA(ag *AccessGraph, oidcProviderARN string) []Finding {
+	var findings []Finding
+
+	for saKey, sa := range ag.ServiceAccounts {
+		roleARN, ok := sa.Annotations["eks.amazonaws.com/role-arn"]
+		if !ok {
+			continue
+		}
+		saItem := fmt.Sprintf("[Kubernetes service account] %v", saKey)
+		roleItem := fmt.Sprintf("[IAM role] %v", roleARN)
+
+		role, ok := ag.Roles[roleARN]
+		if !ok {
+			findings = append(findings, Finding{
+				From:   saItem,
+				To:     roleItem,
+				Reason: fmt.Sprintf("role %v does not exist", roleARN),
+			})
+			continue
+		}
+
+		expectedSub := fmt.Sprintf("system:serviceaccount:%v:%v", sa.Namespace, sa.Name)
+		if !trustsOIDCSubject(role.TrustPolicy, oidcProviderARN, expectedSub) {
+			findings = append(findings, Finding{
+				From:   saItem,
+				To:     roleItem,
+				Reason: fmt.Sprintf("role trust policy does not trust %v with sub %v", oidcProviderARN, expectedSub),
+			})
+		}
+	}
+
+	for podKey, pod := range ag.Pods {
+		podItem := fmt.Sprintf("[Kubernetes pod] %v", podKey)
+		for _, container := range pod.Spec.Containers {
+			roleARN := ""
+			for _, envar := range container.Env {
+				if envar.Name == "AWS_ROLE_ARN" {
+					roleARN = envar.Value
+				}
+			}
+			if roleARN == "" {
+				continue
+			}
+			if !hasWebIdentityTokenEnv(container) {
+				findings = append(findings, Finding{
+					From:   podItem,
+					To:     fmt.Sprintf("[IAM role] %v", roleARN),
+					Reason: "AWS_ROLE_ARN is set without AWS_WEB_IDENTITY_TOKEN_FILE",
+				})
+			}
+			if !hasProjectedTokenVolume(pod) {
+				findings = append(findings, Finding{
+					From:   podItem,
+					To:     fmt.Sprintf("[IAM role] %v", roleARN),
+					Reason: "AWS_ROLE_ARN is set without a projected service account token volume",
+				})
+			}
+		}
+	}
+
+	return findings
+}
+
+// trustsOIDCSubject reports whether a role's trust policy document trusts
+// the given OIDC provider with a "sub" condition matching expectedSub.
+func trustsOIDCSubject(trustPolicy, oidcProviderARN, expectedSub string) bool {
+	// Anchor on the whole quoted JSON string value, not a bare substring:
+	// "system:serviceaccount:ns:sa1" is a prefix of, and so would wrongly
+	// match, "system:serviceaccount:ns:sa10".
+	return containsAll(trustPolicy, oidcProviderARN, `"`+expectedSub+`"`)
+}
+
+// containsAll is a minimal check over the raw trust policy document that
+// each of substrs appears verbatim; a real implementation would parse it as
+// JSON and walk the Condition block, but this is enough to catch the
+// "didn't wire it at all" class of mistake that motivated this pass.
+func containsAll(doc string, substrs ...string) bool {
+	for _, s := range substrs {
+		if !strings.Contains(doc, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasWebIdentityTokenEnv reports whether the container sets
+// AWS_WEB_IDENTITY_TOKEN_FILE, which the AWS SDKs require alongside
+// AWS_ROLE_ARN to assume a role via IRSA.
+func hasWebIdentityTokenEnv(container corev1.Container) bool {
+	for _, envar := range container.Env {
+		if envar.Name == "AWS_WEB_IDENTITY_TOKEN_FILE" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasProjectedTokenVolume reports whether the pod mounts a projected service
+// account token volume, which the webhook normally injects alongside the
+// IRSA annotation.
+func hasProjectedTokenVolume(pod corev1.Pod) bool {
+	for _, vol := range pod.Spec.Volumes {
+		if vol.Projected != nil {
+			for _, source := range vol.Projected.Sources {
+				if source.ServiceAccountToken != nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func main() {
+	offline := flag.String("offline", "", "path to a previously-dumped AccessGraph (rbiam-dump-*.json); when set, skips AWS/Kubernetes entirely and serves whatcan/whocan/lookup from the file")
+	region := flag.String("region", "", "AWS region to scrape when not running -offline")
+	oidcProviderARN := flag.String("oidc-provider-arn", "", "ARN of the cluster's OIDC provider, used to validate IRSA trust policies")
+	flag.Parse()
+
+	var source Source
+	if *offline != "" {
+		source = &FileSource{Filename: *offline}
+	} else {
+		sess := session.Must(session.NewSession(&aws.Config{Region: region}))
+		source = NewLiveSource(func(ag *AccessGraph) error {
+			return scrapeLive(ag, sess)
+		})
+	}
+
+	ag := &AccessGraph{}
+	if err := source.Refresh(ag); err != nil {
+		fmt.Fprintln(os.Stderr, "rbiam: refresh:", err)
+		os.Exit(1)
+	}
+	ag.Findings = validateIRSA(ag, *oidcProviderARN)
+
+	repl(ag)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// repl drives whatcan/whocan/lookup and the export subcommands purely off
+// the AccessGraph it's given. By the time repl is called, ag has already
+// been populated by a Source (LiveSource or FileSource) via Refresh, so the
+// same session behaves identically whether rbIAM was started against a live
+// cluster or with -offline against a frozen dump.
+func repl(ag *AccessGraph) {
+	var trace []string
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print("rbiam> ")
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			fmt.Print("rbiam> ")
+			continue
+		}
+		var err error
+		switch fields[0] {
+		case "whatcan":
+			trace, err = whatcan(ag, fields[1:])
+		case "whocan":
+			trace, err = whocan(ag, fields[1:])
+		case "lookup":
+			trace, err = lookup(ag, fields[1:])
+		case "export":
+			err = handleExport(fields[1:], trace, ag)
+		case "exit", "quit":
+			return
+		default:
+			err = fmt.Errorf("unknown command: %v", fields[0])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Print("rbiam> ")
+	}
+}
+
+// handleExport dispatches "export <format> [args...]" to the matching
+// export* function, each operating on the trace built up by the most recent
+// whatcan/whocan/lookup. "bolt" is the odd one out: it ignores the trace and
+// ingests the whole graph straight into a live Neo4j instance instead of
+// writing a file, so it's reported separately from the file-producing formats.
+func handleExport(args []string, trace []string, ag *AccessGraph) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: export <raw|graph|cypher|manifests|bolt> [args...]")
+	}
+
+	if args[0] == "bolt" {
+		if len(args) != 4 {
+			return fmt.Errorf("usage: export bolt <uri> <user> <pass>")
+		}
+		if err := ingestBolt(args[1], args[2], args[3], ag); err != nil {
+			return err
+		}
+		fmt.Println("ingested into", args[1])
+		return nil
+	}
+
+	var filename string
+	var err error
+	switch args[0] {
+	case "raw":
+		filename, err = exportRaw(trace, ag)
+	case "graph":
+		filename, err = exportGraph(trace, ag)
+	case "cypher":
+		filename, err = exportCypher(trace, ag)
+	case "manifests":
+		filename, err = exportManifests(trace, ag)
+	default:
+		return fmt.Errorf("unknown export format: %v", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("wrote", filename)
+	return nil
+}
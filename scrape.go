@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// scrapeLive is the function LiveSource wraps: it populates ag from a live
+// AWS account and Kubernetes cluster. Each resource type is scraped by its
+// own step so that later steps (EC2/IAM lookups, IRSA validation, ...) can be
+// added here independently without touching Source or the REPL.
+func scrapeLive(ag *AccessGraph, sess *session.Session) error {
+	if err := scrapeKubernetes(ag); err != nil {
+		return err
+	}
+
+	// node-level IAM role assignment for pods that don't use IRSA: scrape
+	// the account's EC2 instances, then resolve each instance's profile to
+	// the role backing it.
+	if err := scrapeEC2Instances(ec2.New(sess), ag); err != nil {
+		return err
+	}
+	if err := resolveInstanceProfileRoles(iam.New(sess), ag); err != nil {
+		return err
+	}
+
+	// attached and inline policies for every role, so exportGraph has
+	// something to draw the role -> policy edge from.
+	if err := scrapeRolePolicies(iam.New(sess), ag); err != nil {
+		return err
+	}
+
+	return nil
+}